@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2023, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wader/filtertransport"
+)
+
+// BogonFilter checks whether an IP address falls within a set of
+// networks that should never be treated as a legitimate, routable
+// destination -- loopback, private, link-local, and similar ranges.
+//
+// Unlike a fixed, compiled-in list, a BogonFilter's deny and allow lists
+// can be changed at runtime via Deny and Allow, so operators can carve
+// out network-specific exclusions (e.g., an RFC1918 range that is
+// actually a routable transit in their deployment) without recompiling.
+// Allow takes precedence over Deny, so an exclusion can be added without
+// having to first reconstruct the entire deny list.
+type BogonFilter struct {
+	mutex sync.RWMutex
+	allow []net.IPNet
+	deny  []net.IPNet
+}
+
+// NewBogonFilter creates a BogonFilter that denies the given networks.
+func NewBogonFilter(deny []net.IPNet) *BogonFilter {
+	return &BogonFilter{deny: append([]net.IPNet(nil), deny...)}
+}
+
+// Allow sets the networks that are never considered bogons by this
+// filter, regardless of Deny, replacing any previously set allow list.
+func (f *BogonFilter) Allow(networks []net.IPNet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.allow = append([]net.IPNet(nil), networks...)
+}
+
+// Deny sets the networks considered bogons by this filter, replacing any
+// previously set deny list.
+func (f *BogonFilter) Deny(networks []net.IPNet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deny = append([]net.IPNet(nil), networks...)
+}
+
+// Check returns true when IP is a bogon: present in the deny list and
+// not present in the allow list.
+func (f *BogonFilter) Check(IP net.IP) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if filtertransport.FindIPNet(f.allow, IP) {
+		return false
+	}
+	return filtertransport.FindIPNet(f.deny, IP)
+}
+
+// NewDefaultBogonFilter creates a BogonFilter with the same deny list
+// IsBogon has always used: filtertransport's fixed, IPv4-heavy list.
+func NewDefaultBogonFilter() *BogonFilter {
+	return NewBogonFilter(filtertransport.DefaultFilteredNetworks)
+}
+
+// NewStrictBogonFilter creates a BogonFilter that extends the default
+// deny list with additional IPv6 and special-purpose IPv4 ranges not
+// covered by filtertransport.DefaultFilteredNetworks: IPv6 unique-local
+// and link-local addresses, IPv6 and IPv4 documentation ranges, CGNAT
+// (RFC 6598), and 0.0.0.0/8.
+func NewStrictBogonFilter() *BogonFilter {
+	deny := append(
+		append([]net.IPNet(nil), filtertransport.DefaultFilteredNetworks...),
+		strictBogonNetworks...)
+	return NewBogonFilter(deny)
+}
+
+// NewPermissiveBogonFilter creates a BogonFilter with an empty deny list,
+// so Check always returns false. This is intended for use in tests that
+// need to exercise code paths gated on IsBogon without depending on the
+// test environment's network configuration.
+func NewPermissiveBogonFilter() *BogonFilter {
+	return NewBogonFilter(nil)
+}
+
+var strictBogonNetworks = []net.IPNet{
+	mustParseCIDR("fc00::/7"),        // unique local
+	mustParseCIDR("fe80::/10"),       // link-local
+	mustParseCIDR("2001:db8::/32"),   // documentation
+	mustParseCIDR("192.0.2.0/24"),    // documentation (TEST-NET-1)
+	mustParseCIDR("198.51.100.0/24"), // documentation (TEST-NET-2)
+	mustParseCIDR("203.0.113.0/24"),  // documentation (TEST-NET-3)
+	mustParseCIDR("100.64.0.0/10"),   // carrier-grade NAT (RFC 6598)
+	mustParseCIDR("0.0.0.0/8"),       // "this" network
+}
+
+func mustParseCIDR(s string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *ipNet
+}
+
+// defaultBogonFilter is the package-level BogonFilter used by IsBogon.
+// It's an atomic.Value, rather than a plain package variable guarded by
+// a mutex, so that SetDefaultBogonFilter can swap it without callers of
+// IsBogon observing any lock contention.
+var defaultBogonFilter atomic.Value // *BogonFilter
+
+func init() {
+	defaultBogonFilter.Store(NewDefaultBogonFilter())
+}
+
+// SetDefaultBogonFilter atomically replaces the package-level default
+// BogonFilter used by IsBogon.
+func SetDefaultBogonFilter(filter *BogonFilter) {
+	defaultBogonFilter.Store(filter)
+}
+
+// GetDefaultBogonFilter returns the package-level default BogonFilter
+// used by IsBogon.
+func GetDefaultBogonFilter() *BogonFilter {
+	return defaultBogonFilter.Load().(*BogonFilter)
+}
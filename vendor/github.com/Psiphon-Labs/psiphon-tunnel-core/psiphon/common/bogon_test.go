@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewStrictBogonFilterCoversIPv6AndSpecialPurposeRanges(t *testing.T) {
+	filter := NewStrictBogonFilter()
+
+	bogons := []string{
+		"fc00::1",      // unique-local
+		"fe80::1",      // link-local
+		"2001:db8::1",  // documentation
+		"192.0.2.1",    // documentation (TEST-NET-1)
+		"198.51.100.1", // documentation (TEST-NET-2)
+		"203.0.113.1",  // documentation (TEST-NET-3)
+		"100.64.0.1",   // carrier-grade NAT
+		"0.0.0.1",      // "this" network
+		"127.0.0.1",    // still covered by the default list
+		"192.168.1.1",  // still covered by the default list
+	}
+	for _, s := range bogons {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			t.Fatalf("net.ParseIP(%q) failed", s)
+		}
+		if !filter.Check(ip) {
+			t.Errorf("expected %s to be a bogon under NewStrictBogonFilter", s)
+		}
+	}
+
+	notBogons := []string{
+		"8.8.8.8",
+		"2606:4700:4700::1111",
+	}
+	for _, s := range notBogons {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			t.Fatalf("net.ParseIP(%q) failed", s)
+		}
+		if filter.Check(ip) {
+			t.Errorf("expected %s not to be a bogon under NewStrictBogonFilter", s)
+		}
+	}
+}
+
+func TestBogonFilterAllowTakesPrecedenceOverDeny(t *testing.T) {
+	_, denyNet, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR: %v", err)
+	}
+	filter := NewBogonFilter([]net.IPNet{*denyNet})
+
+	ip := net.ParseIP("10.1.2.3")
+	if ip == nil {
+		t.Fatalf("net.ParseIP failed")
+	}
+	if !filter.Check(ip) {
+		t.Fatalf("expected %s to be denied before any Allow call", ip)
+	}
+
+	_, allowNet, err := net.ParseCIDR("10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR: %v", err)
+	}
+	filter.Allow([]net.IPNet{*allowNet})
+
+	if filter.Check(ip) {
+		t.Fatalf("expected Allow to take precedence over Deny for %s", ip)
+	}
+
+	// An address still covered by Deny but not by the narrower Allow
+	// range remains a bogon.
+	otherIP := net.ParseIP("10.2.0.1")
+	if otherIP == nil {
+		t.Fatalf("net.ParseIP failed")
+	}
+	if !filter.Check(otherIP) {
+		t.Fatalf("expected %s, outside the allow range, to remain denied", otherIP)
+	}
+}
+
+func TestNewPermissiveBogonFilterNeverFlags(t *testing.T) {
+	filter := NewPermissiveBogonFilter()
+
+	for _, s := range []string{"127.0.0.1", "10.0.0.1", "fc00::1", "8.8.8.8"} {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			t.Fatalf("net.ParseIP(%q) failed", s)
+		}
+		if filter.Check(ip) {
+			t.Errorf("expected %s not to be flagged by NewPermissiveBogonFilter", s)
+		}
+	}
+}
+
+func TestSetDefaultBogonFilterSwapsIsBogon(t *testing.T) {
+	original := GetDefaultBogonFilter()
+	defer SetDefaultBogonFilter(original)
+
+	permissive := NewPermissiveBogonFilter()
+	SetDefaultBogonFilter(permissive)
+	if GetDefaultBogonFilter() != permissive {
+		t.Fatalf("expected GetDefaultBogonFilter to return the filter just installed")
+	}
+
+	ip := net.ParseIP("10.0.0.1")
+	if ip == nil {
+		t.Fatalf("net.ParseIP failed")
+	}
+	if IsBogon(ip) {
+		t.Fatalf("expected %s not to be a bogon once the permissive filter is installed", ip)
+	}
+
+	strict := NewStrictBogonFilter()
+	SetDefaultBogonFilter(strict)
+	if GetDefaultBogonFilter() != strict {
+		t.Fatalf("expected GetDefaultBogonFilter to return the filter just installed")
+	}
+	if !IsBogon(ip) {
+		t.Fatalf("expected %s to be a bogon once the strict filter is installed", ip)
+	}
+}
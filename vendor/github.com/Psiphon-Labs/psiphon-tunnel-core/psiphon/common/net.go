@@ -32,7 +32,6 @@ import (
 	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/miekg/dns"
-	"github.com/wader/filtertransport"
 )
 
 // NetDialer mimicks the net.Dialer interface.
@@ -270,6 +269,10 @@ type ActivityMonitoredConn struct {
 	activeOnWrite     bool
 	activityUpdater   ActivityUpdater
 	lruEntry          *LRUConnsEntry
+	readLimiter       atomic.Value // *tokenBucket
+	writeLimiter      atomic.Value // *tokenBucket
+	readDeadline      atomic.Value // time.Time
+	writeDeadline     atomic.Value // time.Time
 }
 
 // ActivityUpdater defines an interface for receiving updates for
@@ -279,6 +282,207 @@ type ActivityUpdater interface {
 	UpdateProgress(bytesRead, bytesWritten int64, durationNanoseconds int64)
 }
 
+// ThrottleObserver is an optional extension to ActivityUpdater. When the
+// ActivityUpdater passed to NewActivityMonitoredConn also implements
+// ThrottleObserver, ActivityMonitoredConn reports time spent waiting for
+// rate limit tokens via ObserveThrottleDelay, so throttled-away time is
+// distinguishable from time genuinely spent on the wire.
+type ThrottleObserver interface {
+	ObserveThrottleDelay(delay time.Duration)
+}
+
+// RateLimits specifies read/write rate limits to apply to an
+// ActivityMonitoredConn. A zero ReadBytesPerSecond or WriteBytesPerSecond
+// disables limiting in that direction. ReadBurstBytes/WriteBurstBytes
+// default to the corresponding *BytesPerSecond value when left at 0.
+// UnthrottledBytes is an initial, one-time allowance, applied to both
+// directions independently, that is exempt from throttling; it's
+// intended to let small control exchanges proceed without delay.
+type RateLimits struct {
+	ReadBytesPerSecond  int64
+	WriteBytesPerSecond int64
+	ReadBurstBytes      int64
+	WriteBurstBytes     int64
+	UnthrottledBytes    int64
+}
+
+// SetRateLimits sets, or clears when limits is the zero value, the
+// rate limits applied to Read and Write. SetRateLimits may be called at
+// any time; each direction's new limit takes effect on that direction's
+// next Read/Write.
+func (conn *ActivityMonitoredConn) SetRateLimits(limits RateLimits) {
+	conn.readLimiter.Store(
+		newTokenBucket(limits.ReadBytesPerSecond, limits.ReadBurstBytes, limits.UnthrottledBytes))
+	conn.writeLimiter.Store(
+		newTokenBucket(limits.WriteBytesPerSecond, limits.WriteBurstBytes, limits.UnthrottledBytes))
+}
+
+// tokenBucket is a token-bucket rate limiter. Tokens are refilled
+// lazily, based on elapsed monotonic time, when take is called.
+type tokenBucket struct {
+	mutex       sync.Mutex
+	ratePerNano float64
+	burst       float64
+	tokens      float64
+	lastRefill  int64 // monotime.Time
+	unthrottled int64 // atomic; initial free allowance
+}
+
+// newTokenBucket returns nil, meaning unthrottled, when bytesPerSecond
+// is not positive.
+func newTokenBucket(bytesPerSecond, burstBytes, unthrottledBytes int64) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if burstBytes <= 0 {
+		burstBytes = bytesPerSecond
+	}
+	return &tokenBucket{
+		ratePerNano: float64(bytesPerSecond) / float64(time.Second),
+		burst:       float64(burstBytes),
+		tokens:      float64(burstBytes),
+		lastRefill:  int64(monotime.Now()),
+		unthrottled: unthrottledBytes,
+	}
+}
+
+// take returns the number of bytes, up to requested, that may be
+// transferred immediately, and whether that allowance was drawn from the
+// unthrottled allowance rather than the token bucket itself. When the
+// returned count is 0, it also returns the delay until at least one more
+// token will be available; otherwise the returned delay is 0.
+//
+// take debits the full returned count up front, before the caller has
+// actually performed the I/O; callers whose ioFunc transfers fewer bytes
+// than allowed (a short Read/Write, which is routine for a net.Conn) must
+// call release with the unused remainder so the bucket reflects bytes
+// actually transferred, not bytes merely authorized.
+func (b *tokenBucket) take(requested int64) (int64, bool, time.Duration) {
+
+	// The unthrottled allowance is debited before any throttling kicks
+	// in, and is not replenished, other than via release below.
+	if remaining := atomic.LoadInt64(&b.unthrottled); remaining > 0 {
+		n := requested
+		if n > remaining {
+			n = remaining
+		}
+		atomic.AddInt64(&b.unthrottled, -n)
+		return n, true, 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := int64(monotime.Now())
+	if elapsed := now - b.lastRefill; elapsed > 0 {
+		b.tokens += float64(elapsed) * b.ratePerNano
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.lastRefill = now
+	}
+
+	if b.tokens < 1 {
+		return 0, false, time.Duration((1 - b.tokens) / b.ratePerNano)
+	}
+
+	n := requested
+	if float64(n) > b.tokens {
+		n = int64(b.tokens)
+	}
+	b.tokens -= float64(n)
+	return n, false, 0
+}
+
+// release returns n previously-taken bytes that were authorized via take
+// but never actually transferred (e.g. a short Read/Write), crediting
+// them back to whichever of the unthrottled allowance or the token
+// bucket they were drawn from, per fromUnthrottled.
+func (b *tokenBucket) release(n int64, fromUnthrottled bool) {
+	if n <= 0 {
+		return
+	}
+
+	if fromUnthrottled {
+		atomic.AddInt64(&b.unthrottled, n)
+		return
+	}
+
+	b.mutex.Lock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mutex.Unlock()
+}
+
+// rateLimitTimeoutError is returned when a throttled Read or Write
+// cannot proceed before the conn's existing deadline expires.
+type rateLimitTimeoutError struct{}
+
+func (rateLimitTimeoutError) Error() string   { return "rate limit: i/o timeout" }
+func (rateLimitTimeoutError) Timeout() bool   { return true }
+func (rateLimitTimeoutError) Temporary() bool { return true }
+
+// rateLimitedIO applies limiter, if any, to a single Read or Write,
+// sleeping as needed until enough tokens are available and then
+// performing ioFunc for up to that many bytes. Sleeps are capped to
+// deadlineValue, which must be the read or write deadline matching the
+// direction being throttled (conn.readDeadline for a Read, conn.
+// writeDeadline for a Write; these are tracked independently, exactly as
+// net.Conn's SetReadDeadline/SetWriteDeadline are independent), so
+// throttling cannot be used to silently bypass a caller-specified
+// timeout, and a deadline set for one direction cannot cut short a
+// throttled operation in the other direction. The returned duration is
+// the total time spent waiting for tokens, for ThrottleObserver.
+func (conn *ActivityMonitoredConn) rateLimitedIO(
+	limiterValue *atomic.Value,
+	deadlineValue *atomic.Value,
+	buffer []byte,
+	ioFunc func([]byte) (int, error)) (int, error, time.Duration) {
+
+	limiter, _ := limiterValue.Load().(*tokenBucket)
+	if limiter == nil || len(buffer) == 0 {
+		n, err := ioFunc(buffer)
+		return n, err, 0
+	}
+
+	var throttled time.Duration
+	for {
+		allowed, fromUnthrottled, wait := limiter.take(int64(len(buffer)))
+		if allowed > 0 {
+			n, err := ioFunc(buffer[:allowed])
+
+			// ioFunc (a net.Conn's Read or Write) is free to transfer
+			// fewer bytes than allowed -- a short read is routine
+			// net.Conn behavior, not an edge case -- so only the bytes
+			// actually transferred should be debited; release the rest
+			// back to the bucket they were taken from so the achieved
+			// rate matches the configured rate instead of being
+			// throttled down by bytes that were authorized but never
+			// sent.
+			if unused := allowed - int64(n); unused > 0 {
+				limiter.release(unused, fromUnthrottled)
+			}
+
+			return n, err, throttled
+		}
+
+		if deadline, ok := deadlineValue.Load().(time.Time); ok && !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return 0, rateLimitTimeoutError{}, throttled
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+
+		time.Sleep(wait)
+		throttled += wait
+	}
+}
+
 // NewActivityMonitoredConn creates a new ActivityMonitoredConn.
 func NewActivityMonitoredConn(
 	conn net.Conn,
@@ -287,8 +491,10 @@ func NewActivityMonitoredConn(
 	activityUpdater ActivityUpdater,
 	lruEntry *LRUConnsEntry) (*ActivityMonitoredConn, error) {
 
+	var deadline time.Time
 	if inactivityTimeout > 0 {
-		err := conn.SetDeadline(time.Now().Add(inactivityTimeout))
+		deadline = time.Now().Add(inactivityTimeout)
+		err := conn.SetDeadline(deadline)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -296,7 +502,7 @@ func NewActivityMonitoredConn(
 
 	now := int64(monotime.Now())
 
-	return &ActivityMonitoredConn{
+	activityConn := &ActivityMonitoredConn{
 		Conn:                 conn,
 		inactivityTimeout:    inactivityTimeout,
 		activeOnWrite:        activeOnWrite,
@@ -305,7 +511,13 @@ func NewActivityMonitoredConn(
 		lastReadActivityTime: now,
 		activityUpdater:      activityUpdater,
 		lruEntry:             lruEntry,
-	}, nil
+	}
+	if !deadline.IsZero() {
+		activityConn.readDeadline.Store(deadline)
+		activityConn.writeDeadline.Store(deadline)
+	}
+
+	return activityConn, nil
 }
 
 // GetStartTime gets the time when the ActivityMonitoredConn was
@@ -327,11 +539,16 @@ func (conn *ActivityMonitoredConn) GetLastActivityMonotime() monotime.Time {
 }
 
 func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
-	n, err := conn.Conn.Read(buffer)
+	n, err, throttled := conn.rateLimitedIO(&conn.readLimiter, &conn.readDeadline, buffer, conn.Conn.Read)
 	if err == nil {
 
+		// The inactivity deadline, and lastReadActivityTime/UpdateProgress
+		// below, are set based on when this Read completes, exactly as
+		// before rate limiting was introduced: the deadline extension is
+		// driven by real activity actually completing, throttled or not,
+		// and is not backdated to when the Read attempt began.
 		if conn.inactivityTimeout > 0 {
-			err = conn.Conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
+			err = conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
 			if err != nil {
 				return n, errors.Trace(err)
 			}
@@ -342,6 +559,11 @@ func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
 		if conn.activityUpdater != nil {
 			conn.activityUpdater.UpdateProgress(
 				int64(n), 0, readActivityTime-atomic.LoadInt64(&conn.lastReadActivityTime))
+			if throttled > 0 {
+				if observer, ok := conn.activityUpdater.(ThrottleObserver); ok {
+					observer.ObserveThrottleDelay(throttled)
+				}
+			}
 		}
 
 		if conn.lruEntry != nil {
@@ -356,11 +578,11 @@ func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
 }
 
 func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
-	n, err := conn.Conn.Write(buffer)
+	n, err, throttled := conn.rateLimitedIO(&conn.writeLimiter, &conn.writeDeadline, buffer, conn.Conn.Write)
 	if err == nil && conn.activeOnWrite {
 
 		if conn.inactivityTimeout > 0 {
-			err = conn.Conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
+			err = conn.SetDeadline(time.Now().Add(conn.inactivityTimeout))
 			if err != nil {
 				return n, errors.Trace(err)
 			}
@@ -368,6 +590,11 @@ func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
 
 		if conn.activityUpdater != nil {
 			conn.activityUpdater.UpdateProgress(0, int64(n), 0)
+			if throttled > 0 {
+				if observer, ok := conn.activityUpdater.(ThrottleObserver); ok {
+					observer.ObserveThrottleDelay(throttled)
+				}
+			}
 		}
 
 		if conn.lruEntry != nil {
@@ -379,6 +606,30 @@ func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
 	return n, err
 }
 
+// SetDeadline, SetReadDeadline, and SetWriteDeadline forward to the
+// underlying conn, as before, but also record the deadline so that a
+// throttled Read/Write (see rateLimitedIO) can cap how long it sleeps
+// waiting for tokens, rather than silently overriding the deadline the
+// caller set. Read and write deadlines are tracked independently, the
+// same as net.Conn itself treats them: SetReadDeadline only affects a
+// throttled Read, SetWriteDeadline only affects a throttled Write, and
+// SetDeadline affects both.
+func (conn *ActivityMonitoredConn) SetDeadline(t time.Time) error {
+	conn.readDeadline.Store(t)
+	conn.writeDeadline.Store(t)
+	return conn.Conn.SetDeadline(t)
+}
+
+func (conn *ActivityMonitoredConn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.Store(t)
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *ActivityMonitoredConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.Store(t)
+	return conn.Conn.SetWriteDeadline(t)
+}
+
 // IsClosed implements the Closer iterface. The return value
 // indicates whether the underlying conn has been closed.
 func (conn *ActivityMonitoredConn) IsClosed() bool {
@@ -390,10 +641,12 @@ func (conn *ActivityMonitoredConn) IsClosed() bool {
 }
 
 // IsBogon checks if the specified IP is a bogon (loopback, private addresses,
-// link-local addresses, etc.)
+// link-local addresses, etc.) according to the package-level default
+// BogonFilter. Use SetDefaultBogonFilter to customize this behavior, e.g.
+// to add IPv6 coverage via NewStrictBogonFilter or to carve out a
+// deployment-specific exclusion.
 func IsBogon(IP net.IP) bool {
-	return filtertransport.FindIPNet(
-		filtertransport.DefaultFilteredNetworks, IP)
+	return GetDefaultBogonFilter().Check(IP)
 }
 
 // ParseDNSQuestion parses a DNS message. When the message is a query,
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Defaults applied when UpstreamProxyConfig leaves MaxIdleAuthCacheEntries
+// or AuthCacheTTL at their zero value.
+const (
+	defaultMaxIdleAuthCacheEntries = 100
+	defaultAuthCacheTTL            = 2 * time.Minute
+)
+
+// authCacheEntry caches the HttpAuthenticator negotiated for a proxy, so
+// that a subsequent Dial can send an authenticated CONNECT on the first
+// attempt instead of repeating the unchallenged round-trip that produced
+// the original 407.
+type authCacheEntry struct {
+	key           string
+	authenticator HttpAuthenticator
+	expires       time.Time
+	element       *list.Element
+}
+
+// authCache is a concurrency-safe, size- and TTL-bounded cache of
+// HttpAuthenticators, keyed by proxy address plus username (used here in
+// place of the auth realm, which isn't known until the first challenge).
+// Eviction follows the same recency-ordered list.List approach as
+// common.LRUConns: the most recently used entry is kept at the front and
+// the oldest entry is trimmed first once the cache is over capacity.
+type authCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List
+	entries    map[string]*authCacheEntry
+}
+
+func newAuthCache(maxEntries int, ttl time.Duration) *authCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxIdleAuthCacheEntries
+	}
+	if ttl <= 0 {
+		ttl = defaultAuthCacheTTL
+	}
+	return &authCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*authCacheEntry),
+	}
+}
+
+// get returns the cached authenticator for key, if any and not expired.
+func (c *authCache) get(key string) (HttpAuthenticator, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		c.removeLocked(entry)
+		return nil, false
+	}
+	c.order.MoveToFront(entry.element)
+	return entry.authenticator, true
+}
+
+// put caches authenticator for key, evicting the least recently used
+// entry if the cache is at capacity.
+func (c *authCache) put(key string, authenticator HttpAuthenticator) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.authenticator = authenticator
+		entry.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(entry.element)
+		return
+	}
+
+	entry := &authCacheEntry{
+		key:           key,
+		authenticator: authenticator,
+		expires:       time.Now().Add(c.ttl),
+	}
+	entry.element = c.order.PushFront(entry)
+	c.entries[key] = entry
+
+	for len(c.entries) > c.maxEntries {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeLocked(oldest.Value.(*authCacheEntry))
+	}
+}
+
+// remove evicts key, if present. It's used when a cached authenticator
+// turns out to be stale, so that a failed cached-auth attempt doesn't
+// keep being retried against the same bad entry.
+func (c *authCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		c.removeLocked(entry)
+	}
+}
+
+// removeLocked removes entry from the cache. c.mutex must be held.
+func (c *authCache) removeLocked(entry *authCacheEntry) {
+	c.order.Remove(entry.element)
+	delete(c.entries, entry.key)
+}
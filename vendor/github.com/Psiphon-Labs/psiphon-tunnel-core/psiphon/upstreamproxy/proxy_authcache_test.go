@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAuthenticator is a minimal HttpAuthenticator used only to identify
+// which cache entry a get call returned.
+type fakeAuthenticator struct {
+	id int
+}
+
+func (a *fakeAuthenticator) Authenticate(req *http.Request, resp *http.Response) error {
+	return nil
+}
+
+func TestAuthCacheGetPutRemove(t *testing.T) {
+	c := newAuthCache(0, 0)
+
+	if _, ok := c.get("key"); ok {
+		t.Fatalf("expected a miss on an empty cache")
+	}
+
+	want := &fakeAuthenticator{id: 1}
+	c.put("key", want)
+
+	got, ok := c.get("key")
+	if !ok {
+		t.Fatalf("expected a hit after put")
+	}
+	if got != want {
+		t.Fatalf("expected to get back the authenticator that was put")
+	}
+
+	c.remove("key")
+	if _, ok := c.get("key"); ok {
+		t.Fatalf("expected a miss after remove")
+	}
+}
+
+func TestAuthCacheTTLExpiry(t *testing.T) {
+	c := newAuthCache(0, time.Millisecond)
+
+	c.put("key", &fakeAuthenticator{id: 1})
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := c.get("key"); ok {
+		t.Fatalf("expected the entry to have expired")
+	}
+}
+
+func TestAuthCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newAuthCache(2, 0)
+
+	c.put("a", &fakeAuthenticator{id: 1})
+	c.put("b", &fakeAuthenticator{id: 2})
+
+	// Touch "a" so "b" becomes the least recently used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("expected a hit for \"a\"")
+	}
+
+	c.put("c", &fakeAuthenticator{id: 3})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("expected \"b\" to have been evicted as the least recently used entry")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatalf("expected \"a\" to survive eviction")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatalf("expected \"c\" to have been cached")
+	}
+}
+
+// TestAuthCacheConcurrentAccess exercises get/put/remove from many
+// goroutines at once under the race detector, to check the claimed
+// concurrency-safety of authCache.
+func TestAuthCacheConcurrentAccess(t *testing.T) {
+	c := newAuthCache(16, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i%8)
+			for j := 0; j < 100; j++ {
+				c.put(key, &fakeAuthenticator{id: i})
+				c.get(key)
+				if j%10 == 0 {
+					c.remove(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
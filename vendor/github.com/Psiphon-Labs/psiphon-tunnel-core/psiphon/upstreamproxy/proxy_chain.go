@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamProxyHop describes a single hop in an UpstreamProxyChain: the
+// proxy's URL (scheme, host, and optional embedded credentials) plus any
+// headers that should accompany that hop's own CONNECT request.
+type UpstreamProxyHop struct {
+	URL           *url.URL
+	CustomHeaders http.Header
+}
+
+// UpstreamProxyChain composes an ordered list of upstream proxies into a
+// single proxy.Dialer that tunnels through every hop in turn: hop N's
+// forward dialer is hop N-1, and the final hop's CONNECT/SOCKS request
+// targets the ultimate destination address passed to Dial. This fronts
+// one obfuscation proxy with another (CONNECT-over-CONNECT, SOCKS-over-
+// CONNECT, etc.) without callers hand-rolling the composition.
+//
+// Each hop's dialer is built via proxy.FromURL, so any scheme registered
+// with proxy.RegisterDialerType -- including this package's "http"
+// dialer -- composes for free. "socks5" hops are built with this
+// package's newSOCKS5 directly, since proxy.FromURL handles that scheme
+// itself without consulting the registered dialer.
+type UpstreamProxyChain struct {
+	hops []UpstreamProxyHop
+	dial func(network, addr string) (net.Conn, error)
+}
+
+// NewUpstreamProxyChain builds a dialer that tunnels through each of hops
+// in order. forward, if non-nil, is used to reach the first hop and
+// defaults to proxy.Direct.
+func NewUpstreamProxyChain(hops []UpstreamProxyHop, forward proxy.Dialer) (*UpstreamProxyChain, error) {
+	if len(hops) == 0 {
+		return nil, proxyError(fmt.Errorf("UpstreamProxyChain: at least one hop is required"))
+	}
+
+	if forward == nil {
+		forward = proxy.Direct
+	}
+
+	var dialer proxy.Dialer = forward
+	for i, hop := range hops {
+		if hop.URL == nil {
+			return nil, proxyError(fmt.Errorf("UpstreamProxyChain: hop %d has no URL", i))
+		}
+
+		var hopDialer proxy.Dialer
+		var err error
+		if hop.URL.Scheme == "socks5" {
+			hopDialer, err = newSOCKS5(hop.URL, dialer)
+		} else {
+			hopDialer, err = proxy.FromURL(hop.URL, dialer)
+		}
+		if err != nil {
+			return nil, proxyError(fmt.Errorf(
+				"UpstreamProxyChain: building hop %d (%s): %v", i, hop.URL.Scheme, err))
+		}
+
+		if hp, ok := hopDialer.(*httpProxy); ok && hop.CustomHeaders != nil {
+			hp.customHeaders = hop.CustomHeaders
+		}
+
+		// Note: there's no up-front check that this hop's dialer can
+		// reach the next hop's address. Both of this package's schemes,
+		// "http" (CONNECT) and "socks5" (DOMAINNAME/IPv4/IPv6 ATYP),
+		// accept any hostname, IPv4, or IPv6 address as their target, so
+		// there is currently no real address-family restriction to
+		// enforce. If a future scheme is added that can't reach some
+		// next-hop address forms (e.g. one that requires a pre-resolved
+		// IP), add a real check here rather than reviving a check that
+		// can never actually reject anything.
+
+		// Wrap hopDialer so that any error it returns -- whether from its
+		// own handshake or bubbled up from an earlier hop's forward.Dial
+		// -- is tagged with this hop's position and scheme before it's
+		// passed along as the next hop's forward. This way the error
+		// returned by the outermost (last) hop's Dial carries one
+		// "hop i (scheme)" annotation per hop the failure passed through,
+		// with the outermost hop's annotation first and the innermost
+		// (the actual point of failure) last in the wrapped message.
+		dialer = &chainHopDialer{index: i, scheme: hop.URL.Scheme, forward: hopDialer}
+	}
+
+	return &UpstreamProxyChain{hops: hops, dial: dialer.Dial}, nil
+}
+
+// chainHopDialer wraps a single hop's dialer so that Dial errors --
+// including ones that originate in an earlier hop and bubble up through
+// this hop's own forward.Dial call -- are tagged with this hop's
+// position and scheme.
+type chainHopDialer struct {
+	index   int
+	scheme  string
+	forward proxy.Dialer
+}
+
+func (h *chainHopDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := h.forward.Dial(network, addr)
+	if err != nil {
+		return nil, proxyError(fmt.Errorf("hop %d (%s): %v", h.index, h.scheme, err))
+	}
+	return conn, nil
+}
+
+// Dial tunnels through every hop in the chain and returns a net.Conn to
+// addr as seen from the far end of the last hop.
+func (chain *UpstreamProxyChain) Dial(network, addr string) (net.Conn, error) {
+	return chain.dial(network, addr)
+}
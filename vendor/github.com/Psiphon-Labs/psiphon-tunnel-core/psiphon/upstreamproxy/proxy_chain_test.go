@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestUpstreamProxyChainTunnelsThroughTwoHops chains an HTTP CONNECT
+// proxy in front of a SOCKS5 proxy -- the first hop's CONNECT target is
+// the second hop's address -- and confirms the resulting dialer can
+// still tunnel end-to-end to whatever address the second hop is asked
+// to reach.
+func TestUpstreamProxyChainTunnelsThroughTwoHops(t *testing.T) {
+	connectAddr := startConnectProxy(t)
+	socks5Addr := startSOCKS5Proxy(t, socks5TestServerConfig{})
+
+	hops := []UpstreamProxyHop{
+		{URL: &url.URL{Scheme: "http", Host: connectAddr}},
+		{URL: &url.URL{Scheme: "socks5", Host: socks5Addr}},
+	}
+
+	chain, err := NewUpstreamProxyChain(hops, nil)
+	if err != nil {
+		t.Fatalf("NewUpstreamProxyChain: %v", err)
+	}
+
+	dialEcho(t, chain, "example.com:1234")
+}
+
+// TestUpstreamProxyChainAttributesNonLastHopFailure breaks the chain at
+// its first (non-last) hop by pointing it at a second hop address that
+// nothing is listening on, and checks that chainHopDialer.Dial reports
+// the failure tagged with the hop that actually failed, not just the
+// outermost hop.
+func TestUpstreamProxyChainAttributesNonLastHopFailure(t *testing.T) {
+	connectAddr := startConnectProxy(t)
+
+	hops := []UpstreamProxyHop{
+		{URL: &url.URL{Scheme: "http", Host: connectAddr}},
+		// Nothing listens here, so the first hop's CONNECT to this
+		// address fails before the second hop's SOCKS5 handshake ever
+		// starts.
+		{URL: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1"}},
+	}
+
+	chain, err := NewUpstreamProxyChain(hops, nil)
+	if err != nil {
+		t.Fatalf("NewUpstreamProxyChain: %v", err)
+	}
+
+	_, err = chain.Dial("tcp", "example.com:1234")
+	if err == nil {
+		t.Fatalf("expected Dial to fail")
+	}
+	if !strings.Contains(err.Error(), "hop 0 (http)") {
+		t.Fatalf("expected error to attribute the failure to hop 0 (http), got: %v", err)
+	}
+}
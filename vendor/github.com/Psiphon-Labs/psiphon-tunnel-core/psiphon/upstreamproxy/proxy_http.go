@@ -57,6 +57,13 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// errCachedAuthUnusable is returned internally by proxyConn.handshake when
+// a cached HttpAuthenticator can't produce a request without a prior 407
+// challenge. httpProxy.Dial catches it and retries the handshake
+// unchallenged within the same Dial call instead of surfacing it to the
+// caller.
+var errCachedAuthUnusable = fmt.Errorf("upstreamproxy: cached auth unusable without a prior challenge")
+
 // httpProxy is a HTTP connect proxy.
 type httpProxy struct {
 	hostPort      string
@@ -64,6 +71,8 @@ type httpProxy struct {
 	password      string
 	forward       proxy.Dialer
 	customHeaders http.Header
+	authCache     *authCache
+	authCacheKey  string
 }
 
 func newHTTP(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
@@ -75,9 +84,15 @@ func newHTTP(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 		hp.password, _ = uri.User.Password()
 	}
 
+	maxIdleAuthCacheEntries := 0
+	authCacheTTL := time.Duration(0)
 	if upstreamProxyConfig, ok := forward.(*UpstreamProxyConfig); ok {
 		hp.customHeaders = upstreamProxyConfig.CustomHeaders
+		maxIdleAuthCacheEntries = upstreamProxyConfig.MaxIdleAuthCacheEntries
+		authCacheTTL = upstreamProxyConfig.AuthCacheTTL
 	}
+	hp.authCache = newAuthCache(maxIdleAuthCacheEntries, authCacheTTL)
+	hp.authCacheKey = hp.hostPort + "|" + hp.username
 
 	return hp, nil
 }
@@ -90,6 +105,20 @@ func (hp *httpProxy) Dial(network, addr string) (net.Conn, error) {
 		proxyAddr:     hp.hostPort,
 		customHeaders: hp.customHeaders,
 	}
+
+	// If a previous Dial to this proxy cached an authenticator, skip the
+	// unchallenged round-trip and send an authenticated CONNECT on the
+	// first attempt. This only pays off for authentication schemes that
+	// don't depend on a fresh server nonce (e.g. Basic); schemes that do
+	// (e.g. Digest) simply get re-challenged with a 407, which is handled
+	// by the normal handshake loop below.
+	usingCachedAuth := false
+	if authenticator, ok := hp.authCache.get(hp.authCacheKey); ok {
+		pc.authenticator = authenticator
+		pc.authState = HTTP_AUTH_STATE_CHALLENGED
+		usingCachedAuth = true
+	}
+
 	err := pc.makeNewClientConn()
 	if err != nil {
 		// Already wrapped in proxyError
@@ -100,14 +129,36 @@ handshakeLoop:
 	for {
 		err := pc.handshake(addr, hp.username, hp.password)
 		if err != nil {
+			if err == errCachedAuthUnusable {
+				// The cached authenticator couldn't produce a request
+				// without a prior 407 challenge, which this Dial call
+				// hasn't received yet (see handshake). Drop it and retry
+				// the handshake as if this Dial had never found anything
+				// in the cache, rather than failing the Dial outright.
+				hp.authCache.remove(hp.authCacheKey)
+				pc.authenticator = nil
+				pc.authResponse = nil
+				pc.authState = HTTP_AUTH_STATE_UNCHALLENGED
+				usingCachedAuth = false
+				continue
+			}
+			if usingCachedAuth {
+				// The cached authenticator didn't work; drop it so later
+				// Dial calls don't keep retrying a bad cache entry.
+				hp.authCache.remove(hp.authCacheKey)
+			}
 			// Already wrapped in proxyError
 			return nil, err
 		}
 		switch pc.authState {
 		case HTTP_AUTH_STATE_SUCCESS:
+			if pc.authenticator != nil {
+				hp.authCache.put(hp.authCacheKey, pc.authenticator)
+			}
 			pc.hijackedConn, pc.staleReader = pc.httpClientConn.Hijack()
 			return pc, nil
 		case HTTP_AUTH_STATE_CHALLENGED:
+			usingCachedAuth = false
 			continue
 		default:
 			break handshakeLoop
@@ -165,8 +216,23 @@ func (pc *proxyConn) handshake(addr, username, password string) error {
 	}
 
 	if pc.authState == HTTP_AUTH_STATE_CHALLENGED {
-		err := pc.authenticator.Authenticate(req, pc.authResponse)
+		authResponse := pc.authResponse
+		if authResponse == nil {
+			// We got here via the optimistic cached-auth path in
+			// httpProxy.Dial: there's a cached authenticator but no 407
+			// response from this Dial call to hand it, because the proxy
+			// hasn't challenged us (yet). Never hand the authenticator a
+			// nil *http.Response: substitute an empty one instead, and if
+			// it can't do its job without a real challenge (e.g. Digest
+			// needs the server's nonce), treat that as errCachedAuthUnusable
+			// so the caller retries unchallenged instead of hard-failing.
+			authResponse = &http.Response{Header: make(http.Header)}
+		}
+		err := pc.authenticator.Authenticate(req, authResponse)
 		if err != nil {
+			if pc.authResponse == nil {
+				return errCachedAuthUnusable
+			}
 			pc.authState = HTTP_AUTH_STATE_FAILURE
 			// Already wrapped in proxyError
 			return err
@@ -256,28 +322,60 @@ func (pc *proxyConn) Close() error {
 }
 
 func (pc *proxyConn) LocalAddr() net.Addr {
-	return pc.hijackedConn.LocalAddr()
+	if addr := pc.hijackedConn.LocalAddr(); addr != nil {
+		return addr
+	}
+	// As with RemoteAddr, below: hijackedConn may be the product of a
+	// forwarding Dialer (e.g. a chained upstream proxy) that doesn't
+	// report its own LocalAddr. An unspecified TCPAddr is a safe, non-nil
+	// placeholder in that case.
+	// Note: returning nil here can crash "tls".
+	return &net.TCPAddr{}
 }
 
 // RemoteAddr returns the network address of the proxy that
-// the proxyConn is connected to.
+// the proxyConn is connected to, not the ultimate destination requested
+// via CONNECT.
 func (pc *proxyConn) RemoteAddr() net.Addr {
+	if addr := pc.hijackedConn.RemoteAddr(); addr != nil {
+		return addr
+	}
+	// hijackedConn may be the product of a forwarding Dialer (e.g. a
+	// chained upstream proxy) that doesn't report its own RemoteAddr, so
+	// fall back to the proxy address this proxyConn was dialed with.
 	// Note: returning nil here can crash "tls".
-	return pc.hijackedConn.RemoteAddr()
+	return proxyAddr(pc.proxyAddr)
 }
 
+// SetDeadline, SetReadDeadline, and SetWriteDeadline forward to the
+// hijacked connection, making proxyConn usable as the underlying
+// transport for net/http.Transport, crypto/tls.Conn handshake timeouts,
+// and any other caller that sets deadlines after the CONNECT handshake
+// completes.
+//
+// Note: when staleReader still has buffered bytes left over from the
+// hijack, Read serves from it directly (see proxyConn.Read) without
+// touching hijackedConn, so a read deadline set here only takes effect
+// once staleReader is drained and reads fall through to hijackedConn.Read.
 func (pc *proxyConn) SetDeadline(t time.Time) error {
-	return proxyError(fmt.Errorf("not supported"))
+	return pc.hijackedConn.SetDeadline(t)
 }
 
 func (pc *proxyConn) SetReadDeadline(t time.Time) error {
-	return proxyError(fmt.Errorf("not supported"))
+	return pc.hijackedConn.SetReadDeadline(t)
 }
 
 func (pc *proxyConn) SetWriteDeadline(t time.Time) error {
-	return proxyError(fmt.Errorf("not supported"))
+	return pc.hijackedConn.SetWriteDeadline(t)
 }
 
+// proxyAddr is a net.Addr backed by a plain "host:port" string, used as a
+// RemoteAddr fallback when the underlying conn doesn't report one.
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "tcp" }
+func (a proxyAddr) String() string  { return string(a) }
+
 func init() {
 	proxy.RegisterDialerType("http", newHTTP)
 }
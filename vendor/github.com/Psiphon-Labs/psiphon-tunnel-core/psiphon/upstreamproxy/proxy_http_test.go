@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startConnectProxy runs a minimal, unauthenticated HTTP CONNECT proxy
+// for the duration of the test, returning its listen address.
+func startConnectProxy(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConnect(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// serveConnect handles a single CONNECT request by tunneling to the
+// requested host:port and relaying bytes in both directions.
+func serveConnect(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer target.Close()
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// TestProxyConnDeadlineForwarding lays a TLS handshake, with a deadline,
+// over a proxyConn tunneled through a local CONNECT proxy. Before
+// SetDeadline/SetReadDeadline/SetWriteDeadline forwarded to
+// hijackedConn, this would fail immediately with a "not supported"
+// proxyError instead of ever reaching the TLS handshake.
+func TestProxyConnDeadlineForwarding(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	proxyAddr := startConnectProxy(t)
+
+	dialer, err := proxy.FromURL(&url.URL{Scheme: "http", Host: proxyAddr}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.FromURL: %v", err)
+	}
+
+	conn, err := dialer.Dial("tcp", targetURL.Host)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("proxyConn.SetDeadline: %v", err)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("tls handshake: %v", err)
+	}
+}
+
+// TestProxyConnDeadlineExpired checks that a deadline set in the past is
+// honored by the TLS handshake layered over proxyConn, rather than being
+// silently ignored.
+func TestProxyConnDeadlineExpired(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	proxyAddr := startConnectProxy(t)
+
+	dialer, err := proxy.FromURL(&url.URL{Scheme: "http", Host: proxyAddr}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.FromURL: %v", err)
+	}
+
+	conn, err := dialer.Dial("tcp", targetURL.Host)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("proxyConn.SetDeadline: %v", err)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err == nil {
+		t.Fatalf("expected tls handshake to fail due to expired deadline")
+	}
+}
+
+// basicAuthHeader formats the "Basic" Proxy-Authorization value for
+// username/password, matching what a real Basic HttpAuthenticator produces.
+func basicAuthHeader(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// startChallengingConnectProxy runs a CONNECT proxy that 407s any request
+// without a valid Basic Proxy-Authorization header for username/password,
+// and tunnels once presented with one.
+func startChallengingConnectProxy(t *testing.T, username, password string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	want := basicAuthHeader(username, password)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveChallengingConnect(conn, want)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveChallengingConnect(conn net.Conn, wantProxyAuthorization string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+
+	if req.Header.Get("Proxy-Authorization") != wantProxyAuthorization {
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"proxy\"\r\n" +
+			"Connection: close\r\n\r\n"))
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer target.Close()
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// fakeStatefulAuthenticator simulates a cached HttpAuthenticator, such as
+// Digest, that was successfully negotiated on a previous Dial but can't
+// produce a request without being handed the server's actual challenge
+// (unlike Basic, which needs only the username/password it already holds).
+type fakeStatefulAuthenticator struct {
+	calls int32
+}
+
+func (a *fakeStatefulAuthenticator) Authenticate(req *http.Request, resp *http.Response) error {
+	atomic.AddInt32(&a.calls, 1)
+	if resp == nil || resp.Header.Get("Proxy-Authenticate") == "" {
+		return errors.New("fake: no challenge to authenticate against")
+	}
+	req.Header.Set("Proxy-Authorization", "Fake ok")
+	return nil
+}
+
+// TestHttpProxyCachedAuthFallsBackWithoutChallenge exercises the case
+// where a cached HttpAuthenticator (see proxy_authcache.go) is used
+// optimistically on the first CONNECT of a Dial call, before any 407 from
+// this call has been seen, and can't do its job without one. Before the
+// nil-response guard in proxyConn.handshake, this called Authenticate
+// with a nil *http.Response and then hard-failed the Dial instead of
+// retrying unchallenged within the same call.
+func TestHttpProxyCachedAuthFallsBackWithoutChallenge(t *testing.T) {
+	const username, password = "alice", "secret"
+
+	proxyAddr := startChallengingConnectProxy(t, username, password)
+
+	dialer, err := proxy.FromURL(
+		&url.URL{Scheme: "http", User: url.UserPassword(username, password), Host: proxyAddr},
+		proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.FromURL: %v", err)
+	}
+	hp, ok := dialer.(*httpProxy)
+	if !ok {
+		t.Fatalf("expected *httpProxy, got %T", dialer)
+	}
+
+	fake := &fakeStatefulAuthenticator{}
+	hp.authCache.put(hp.authCacheKey, fake)
+
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	conn, err := hp.Dial("tcp", targetURL.Host)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if calls := atomic.LoadInt32(&fake.calls); calls != 1 {
+		t.Fatalf("expected the cached authenticator to be tried exactly once, got %d calls", calls)
+	}
+
+	if _, ok := hp.authCache.get(hp.authCacheKey); !ok {
+		t.Fatalf("expected a freshly negotiated authenticator to be cached after fallback")
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at torproject dot org>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package upstreamproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5 protocol constants, as specified in RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPassAuth = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5AuthVersion = 0x01
+	socks5AuthSuccess = 0x00
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4       = 0x01
+	socks5AtypDomainName = 0x03
+	socks5AtypIPv6       = 0x04
+)
+
+var socks5ReplyErrors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Proxy is a SOCKS5 proxy, as specified in RFC 1928, with support
+// for username/password authentication, as specified in RFC 1929.
+type socks5Proxy struct {
+	hostPort string
+	username string
+	password string
+	forward  proxy.Dialer
+}
+
+func newSOCKS5(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	sp := new(socks5Proxy)
+	sp.hostPort = uri.Host
+	sp.forward = forward
+	if uri.User != nil {
+		sp.username = uri.User.Username()
+		sp.password, _ = uri.User.Password()
+	}
+
+	// Note: unlike httpProxy, there is no use for UpstreamProxyConfig's
+	// CustomHeaders here, as the SOCKS5 protocol has no notion of headers.
+
+	return sp, nil
+}
+
+func (sp *socks5Proxy) Dial(network, addr string) (net.Conn, error) {
+	conn, err := sp.forward.Dial("tcp", sp.hostPort)
+	if err != nil {
+		return nil, proxyError(fmt.Errorf("socks5Proxy.Dial: %v", err))
+	}
+
+	err = sp.handshake(conn, addr)
+	if err != nil {
+		conn.Close()
+		// Already wrapped in proxyError
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake performs method negotiation, optional username/password
+// sub-negotiation, and the CONNECT request/reply exchange, leaving conn
+// ready to relay addr's traffic on success.
+func (sp *socks5Proxy) handshake(conn net.Conn, addr string) error {
+
+	err := sp.negotiateMethod(conn)
+	if err != nil {
+		// Already wrapped in proxyError
+		return err
+	}
+
+	err = sp.connect(conn, addr)
+	if err != nil {
+		// Already wrapped in proxyError
+		return err
+	}
+
+	return nil
+}
+
+func (sp *socks5Proxy) negotiateMethod(conn net.Conn) error {
+
+	methods := []byte{socks5MethodNoAuth}
+	if sp.username != "" {
+		methods = []byte{socks5MethodNoAuth, socks5MethodUserPassAuth}
+	}
+
+	request := make([]byte, 0, 2+len(methods))
+	request = append(request, socks5Version, byte(len(methods)))
+	request = append(request, methods...)
+
+	_, err := conn.Write(request)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: sending method selection: %v", err))
+	}
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: reading method selection reply: %v", err))
+	}
+	if reply[0] != socks5Version {
+		return proxyError(fmt.Errorf("socks5Proxy: unexpected protocol version: %d", reply[0]))
+	}
+
+	switch reply[1] {
+	case socks5MethodNoAuth:
+		return nil
+	case socks5MethodUserPassAuth:
+		return sp.authenticate(conn)
+	default:
+		return proxyError(fmt.Errorf("socks5Proxy: no acceptable authentication method"))
+	}
+}
+
+func (sp *socks5Proxy) authenticate(conn net.Conn) error {
+
+	if sp.username == "" {
+		return proxyError(fmt.Errorf("socks5Proxy: server requires username/password authentication"))
+	}
+	if len(sp.username) > 255 || len(sp.password) > 255 {
+		return proxyError(fmt.Errorf("socks5Proxy: username or password too long"))
+	}
+
+	request := make([]byte, 0, 3+len(sp.username)+len(sp.password))
+	request = append(request, socks5AuthVersion, byte(len(sp.username)))
+	request = append(request, sp.username...)
+	request = append(request, byte(len(sp.password)))
+	request = append(request, sp.password...)
+
+	_, err := conn.Write(request)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: sending auth request: %v", err))
+	}
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: reading auth reply: %v", err))
+	}
+	if reply[0] != socks5AuthVersion {
+		return proxyError(fmt.Errorf("socks5Proxy: unexpected auth version: %d", reply[0]))
+	}
+	if reply[1] != socks5AuthSuccess {
+		return proxyError(fmt.Errorf("socks5Proxy: authentication failed, status: %d", reply[1]))
+	}
+
+	return nil
+}
+
+func (sp *socks5Proxy) connect(conn net.Conn, addr string) error {
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: failed to parse target address: %v", err))
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return proxyError(fmt.Errorf("socks5Proxy: invalid target port: %s", portStr))
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socks5AtypIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socks5AtypIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		// A hostname is sent as-is, so resolution happens at the proxy.
+		if len(host) > 255 {
+			return proxyError(fmt.Errorf("socks5Proxy: hostname too long: %s", host))
+		}
+		request = append(request, socks5AtypDomainName, byte(len(host)))
+		request = append(request, host...)
+	}
+
+	request = append(request, byte(port>>8), byte(port))
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: sending connect request: %v", err))
+	}
+
+	// Read the fixed portion of the reply: VER, REP, RSV, ATYP.
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: reading connect reply: %v", err))
+	}
+	if header[0] != socks5Version {
+		return proxyError(fmt.Errorf("socks5Proxy: unexpected protocol version: %d", header[0]))
+	}
+	if header[1] != 0x00 {
+		if msg, ok := socks5ReplyErrors[header[1]]; ok {
+			return proxyError(fmt.Errorf("socks5Proxy: connect failed: %s", msg))
+		}
+		return proxyError(fmt.Errorf("socks5Proxy: connect failed, reply code: %d", header[1]))
+	}
+
+	// The bind address is discarded: proxyConn-style callers only need the
+	// tunnel, not the proxy's local view of the destination.
+	var bindAddrLen int
+	switch header[3] {
+	case socks5AtypIPv4:
+		bindAddrLen = net.IPv4len
+	case socks5AtypIPv6:
+		bindAddrLen = net.IPv6len
+	case socks5AtypDomainName:
+		lengthByte := make([]byte, 1)
+		_, err = io.ReadFull(conn, lengthByte)
+		if err != nil {
+			return proxyError(fmt.Errorf("socks5Proxy: reading bind address length: %v", err))
+		}
+		bindAddrLen = int(lengthByte[0])
+	default:
+		return proxyError(fmt.Errorf("socks5Proxy: unsupported bind address type: %d", header[3]))
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, bindAddrLen+2)) // +2 for the bind port
+	if err != nil {
+		return proxyError(fmt.Errorf("socks5Proxy: reading bind address: %v", err))
+	}
+
+	return nil
+}
+
+func init() {
+	proxy.RegisterDialerType("socks5", newSOCKS5)
+}
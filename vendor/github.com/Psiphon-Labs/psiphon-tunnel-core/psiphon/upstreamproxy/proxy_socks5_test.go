@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5TestServerConfig controls startSOCKS5Proxy's fake server, letting
+// tests exercise no-auth, username/password success, and username/
+// password failure against the real client-side handshake code.
+type socks5TestServerConfig struct {
+	requireAuth  bool
+	wantUsername string
+	wantPassword string
+}
+
+// startSOCKS5Proxy runs a minimal local SOCKS5 server for the duration of
+// the test, returning its listen address.
+func startSOCKS5Proxy(t *testing.T, cfg socks5TestServerConfig) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, cfg)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// serveSOCKS5 handles a single client: method negotiation, the optional
+// username/password sub-negotiation, and a CONNECT request of any ATYP.
+// On success, it replies with an arbitrary bind address and then echoes
+// whatever the client sends, so tests can confirm the tunnel itself works
+// end-to-end, not just the handshake.
+func serveSOCKS5(conn net.Conn, cfg socks5TestServerConfig) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socks5Version {
+		return
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	selected := byte(socks5MethodNoAcceptable)
+	for _, m := range methods {
+		if cfg.requireAuth && m == socks5MethodUserPassAuth {
+			selected = socks5MethodUserPassAuth
+		} else if !cfg.requireAuth && m == socks5MethodNoAuth {
+			selected = socks5MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, selected}); err != nil || selected == socks5MethodNoAcceptable {
+		return
+	}
+
+	if selected == socks5MethodUserPassAuth {
+		authHeader := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authHeader); err != nil {
+			return
+		}
+		username := make([]byte, int(authHeader[1]))
+		if _, err := io.ReadFull(conn, username); err != nil {
+			return
+		}
+		passwordLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, passwordLen); err != nil {
+			return
+		}
+		password := make([]byte, int(passwordLen[0]))
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+
+		status := byte(socks5AuthSuccess)
+		if string(username) != cfg.wantUsername || string(password) != cfg.wantPassword {
+			status = 0x01
+		}
+		if _, err := conn.Write([]byte{socks5AuthVersion, status}); err != nil || status != socks5AuthSuccess {
+			return
+		}
+	}
+
+	// Read the CONNECT request: VER, CMD, RSV, ATYP, followed by the
+	// address (whose length depends on ATYP) and a 2-byte port. The
+	// address itself is discarded; this is a fake proxy, not a router.
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != socks5CmdConnect {
+		return
+	}
+
+	var addrLen int
+	switch request[3] {
+	case socks5AtypIPv4:
+		addrLen = net.IPv4len
+	case socks5AtypIPv6:
+		addrLen = net.IPv6len
+	case socks5AtypDomainName:
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lengthByte); err != nil {
+			return
+		}
+		addrLen = int(lengthByte[0])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil { // +2 for the port
+		return
+	}
+
+	reply := []byte{socks5Version, 0x00, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			if _, werr := conn.Write(buffer[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dialEcho dials through dialer and round-trips a fixed payload over the
+// returned conn, failing the test if the echoed bytes don't match.
+func dialEcho(t *testing.T, dialer proxy.Dialer, addr string) {
+	t.Helper()
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	const payload = "ping"
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(reply) != payload {
+		t.Fatalf("expected echoed %q, got %q", payload, reply)
+	}
+}
+
+// TestSOCKS5NoAuthDomainName dials a hostname target (exercising the
+// DOMAINNAME ATYP branch of socks5Proxy.connect) through a SOCKS5 proxy
+// that doesn't require authentication.
+func TestSOCKS5NoAuthDomainName(t *testing.T) {
+	proxyAddr := startSOCKS5Proxy(t, socks5TestServerConfig{})
+
+	dialer, err := newSOCKS5(&url.URL{Scheme: "socks5", Host: proxyAddr}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("newSOCKS5: %v", err)
+	}
+
+	dialEcho(t, dialer, "example.com:1234")
+}
+
+// TestSOCKS5UserPassAuthSuccess dials through a SOCKS5 proxy that
+// requires username/password authentication, supplying valid credentials.
+func TestSOCKS5UserPassAuthSuccess(t *testing.T) {
+	proxyAddr := startSOCKS5Proxy(t, socks5TestServerConfig{
+		requireAuth:  true,
+		wantUsername: "alice",
+		wantPassword: "secret",
+	})
+
+	dialer, err := newSOCKS5(
+		&url.URL{Scheme: "socks5", User: url.UserPassword("alice", "secret"), Host: proxyAddr},
+		proxy.Direct)
+	if err != nil {
+		t.Fatalf("newSOCKS5: %v", err)
+	}
+
+	dialEcho(t, dialer, "example.com:1234")
+}
+
+// TestSOCKS5UserPassAuthFailure dials through a SOCKS5 proxy that
+// requires username/password authentication, supplying the wrong
+// password, and expects Dial to fail rather than silently tunneling.
+func TestSOCKS5UserPassAuthFailure(t *testing.T) {
+	proxyAddr := startSOCKS5Proxy(t, socks5TestServerConfig{
+		requireAuth:  true,
+		wantUsername: "alice",
+		wantPassword: "secret",
+	})
+
+	dialer, err := newSOCKS5(
+		&url.URL{Scheme: "socks5", User: url.UserPassword("alice", "wrong-password"), Host: proxyAddr},
+		proxy.Direct)
+	if err != nil {
+		t.Fatalf("newSOCKS5: %v", err)
+	}
+
+	conn, err := dialer.Dial("tcp", "example.com:1234")
+	if err == nil {
+		conn.Close()
+		t.Fatalf("expected Dial to fail with incorrect credentials")
+	}
+}